@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+)
+
+// RetrievalEventCode identifies the kind of RetrievalEvent.
+type RetrievalEventCode string
+
+const (
+	RetrievalEventStarted       RetrievalEventCode = "started"
+	RetrievalEventConnected     RetrievalEventCode = "connected"
+	RetrievalEventQueryAsked    RetrievalEventCode = "query-asked"
+	RetrievalEventProposed      RetrievalEventCode = "proposed"
+	RetrievalEventFirstByte     RetrievalEventCode = "first-byte"
+	RetrievalEventBlockReceived RetrievalEventCode = "block-received"
+	RetrievalEventFailed        RetrievalEventCode = "failed"
+	RetrievalEventSuccess       RetrievalEventCode = "success"
+)
+
+// RetrievalEvent is emitted throughout a retrieval attempt so that callers
+// can observe its progress programmatically instead of parsing log lines,
+// mirroring the event model used by Lassie.
+type RetrievalEvent struct {
+	Code RetrievalEventCode
+	Time time.Time
+	Root cid.Cid
+
+	// Miner is the zero address.Address for transports/events that aren't
+	// tied to a specific storage provider (e.g. a whole-DHT IPFS attempt).
+	Miner     address.Address
+	Transport multicodec.Code
+
+	// BytesReceived is populated for FirstByte/BlockReceived events, and for
+	// Success events with the total size retrieved.
+	BytesReceived uint64
+
+	// Reason buckets why a Failed event happened into a small fixed set, so
+	// it's safe to use as a metrics label - see RetrievalFailureReason.
+	// Populated for Failed events.
+	Reason RetrievalFailureReason
+
+	// Err is populated for Failed events.
+	Err error
+}
+
+// RetrievalFailureReason classifies why a retrieval attempt failed. Unlike
+// the raw error text (which routinely embeds CIDs, multiaddrs and miner
+// IDs), it's drawn from a small fixed set, making it safe to use as a
+// Prometheus label value - see NewPrometheusRetrievalEventCallback.
+type RetrievalFailureReason string
+
+const (
+	ReasonQueryFailed      RetrievalFailureReason = "query-failed"
+	ReasonConnectFailed    RetrievalFailureReason = "connect-failed"
+	ReasonRetrieveFailed   RetrievalFailureReason = "retrieve-failed"
+	ReasonSelectorMismatch RetrievalFailureReason = "selector-mismatch"
+	ReasonTimeout          RetrievalFailureReason = "timeout"
+	ReasonAllFailed        RetrievalFailureReason = "all-candidates-failed"
+	ReasonUnknown          RetrievalFailureReason = "unknown"
+)
+
+// classifyFailureReason returns stage, unless err is a context deadline -
+// timeouts are worth tracking as their own bucket regardless of which stage
+// they interrupted.
+func classifyFailureReason(stage RetrievalFailureReason, err error) RetrievalFailureReason {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ReasonTimeout
+	}
+	return stage
+}
+
+// RetrievalEventCallback receives RetrievalEvents as a retrieval attempt
+// progresses. It's called inline on the retrieval goroutine, so it must not
+// block for long.
+type RetrievalEventCallback func(RetrievalEvent)
+
+// emitEvent calls request.Events with a populated RetrievalEvent, if one was
+// provided; it's a no-op otherwise.
+func emitEvent(request RetrievalRequest, code RetrievalEventCode, miner address.Address, transport multicodec.Code, bytesReceived uint64, err error) {
+	if request.Events == nil {
+		return
+	}
+
+	request.Events(RetrievalEvent{
+		Code:          code,
+		Time:          time.Now(),
+		Root:          request.Root,
+		Miner:         miner,
+		Transport:     transport,
+		BytesReceived: bytesReceived,
+		Err:           err,
+	})
+}
+
+// emitFailureEvent is emitEvent's RetrievalEventFailed-specific counterpart:
+// it buckets err into a RetrievalFailureReason via classifyFailureReason(stage,
+// err) and populates RetrievalEvent.Reason with the result, in addition to
+// the raw err itself.
+func emitFailureEvent(request RetrievalRequest, miner address.Address, transport multicodec.Code, stage RetrievalFailureReason, err error) {
+	if request.Events == nil {
+		return
+	}
+
+	request.Events(RetrievalEvent{
+		Code:      RetrievalEventFailed,
+		Time:      time.Now(),
+		Root:      request.Root,
+		Miner:     miner,
+		Transport: transport,
+		Reason:    classifyFailureReason(stage, err),
+		Err:       err,
+	})
+}
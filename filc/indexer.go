@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"path"
+
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"golang.org/x/xerrors"
+)
+
+// IndexerCandidateSource discovers retrieval candidates for a CID from an
+// IPNI ("InterPlanetary Network Indexer") reader endpoint such as
+// https://cid.contact, enriching each RetrievalCandidate with the addresses
+// and transports (Graphsync/FIL, Bitswap, HTTP, ...) its provider actually
+// advertised, rather than assuming Graphsync+FIL like the estuary-style
+// endpoint does. See https://github.com/ipni/specs/blob/main/IPNI.md#find
+// for the response format.
+type IndexerCandidateSource struct {
+	Endpoint   string
+	httpClient *http.Client
+}
+
+// NewIndexerCandidateSource returns an IndexerCandidateSource that queries
+// endpoint (e.g. "https://cid.contact") for candidates.
+func NewIndexerCandidateSource(endpoint string) *IndexerCandidateSource {
+	return &IndexerCandidateSource{
+		Endpoint:   endpoint,
+		httpClient: http.DefaultClient,
+	}
+}
+
+// indexerFindResponse mirrors the subset of an IPNI find response that
+// GetRetrievalCandidates cares about.
+type indexerFindResponse struct {
+	MultihashResults []struct {
+		ProviderResults []struct {
+			Metadata string `json:"Metadata"`
+			Provider struct {
+				ID    string   `json:"ID"`
+				Addrs []string `json:"Addrs"`
+			} `json:"Provider"`
+		} `json:"ProviderResults"`
+	} `json:"MultihashResults"`
+}
+
+// GetRetrievalCandidates queries the indexer for c, mirroring
+// (*Node).GetRetrievalCandidates's contract so the two sources can be merged
+// by mergeCandidates.
+func (s *IndexerCandidateSource) GetRetrievalCandidates(ctx context.Context, c cid.Cid) ([]RetrievalCandidate, error) {
+	endpointURL, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, xerrors.Errorf("indexer endpoint %s is not a valid url", s.Endpoint)
+	}
+	endpointURL.Path = path.Join(endpointURL.Path, "cid", c.String())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpointURL.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	// A 404 just means the indexer has nothing for this CID.
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, xerrors.Errorf("indexer request to %s got status %v", endpointURL, resp.StatusCode)
+	}
+
+	var parsed indexerFindResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, xerrors.Errorf("could not unmarshal indexer response for cid %s: %w", c, err)
+	}
+
+	var candidates []RetrievalCandidate
+	for _, mhResult := range parsed.MultihashResults {
+		for _, pr := range mhResult.ProviderResults {
+			candidate := RetrievalCandidate{RootCid: c, PeerID: pr.Provider.ID}
+
+			// pr.Provider.ID is the provider's libp2p peer ID, not a
+			// Filecoin actor address - IPNI has no field that carries the
+			// latter, so candidate.Miner is left address.Undef here.
+			// transportsForCandidate only offers the FIL/graphsync
+			// transport for candidates with a resolved Miner, so an
+			// indexer record advertising TransportGraphsyncFilecoinv1
+			// metadata is correctly limited to its HTTP/bitswap transports
+			// until peer ID -> actor address resolution is implemented.
+
+			for _, raw := range pr.Provider.Addrs {
+				addr, err := multiaddr.NewMultiaddr(raw)
+				if err != nil {
+					log.Debugf("indexer result for %s has unparseable address %s: %v", c, raw, err)
+					continue
+				}
+				candidate.Addrs = append(candidate.Addrs, addr)
+			}
+
+			protocols, err := decodeIndexerMetadata(pr.Metadata)
+			if err != nil {
+				log.Debugf("failed to decode indexer metadata for %s: %v", c, err)
+			}
+			candidate.Protocols = protocols
+
+			candidates = append(candidates, candidate)
+		}
+	}
+
+	return candidates, nil
+}
+
+// decodeIndexerMetadata parses an IPNI provider result's base64-encoded
+// Metadata field into the transports it advertises. The wire format is a
+// sequence of (multicodec transport code, varint-prefixed payload) tuples -
+// see https://github.com/ipni/specs/blob/main/IPNI.md#metadata. We only
+// extract the transport codes, not their payloads (e.g. the piece CID
+// embedded in a Graphsync entry), since that's all RetrievalCandidate.Protocols
+// needs to pick a TransportProtocol.
+func decodeIndexerMetadata(encoded string) ([]multicodec.Code, error) {
+	if encoded == "" {
+		return nil, nil
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, xerrors.Errorf("invalid indexer metadata: %w", err)
+	}
+
+	var protocols []multicodec.Code
+	for len(raw) > 0 {
+		code, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return protocols, xerrors.Errorf("invalid indexer metadata: bad transport code")
+		}
+		raw = raw[n:]
+
+		length, n := binary.Uvarint(raw)
+		if n <= 0 {
+			return protocols, xerrors.Errorf("invalid indexer metadata: bad payload length")
+		}
+		raw = raw[n:]
+		if uint64(len(raw)) < length {
+			return protocols, xerrors.Errorf("invalid indexer metadata: truncated payload")
+		}
+
+		protocols = append(protocols, multicodec.Code(code))
+		raw = raw[length:]
+	}
+
+	return protocols, nil
+}
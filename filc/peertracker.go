@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"golang.org/x/xerrors"
+)
+
+// PeerTrackerRecord holds the retrieval history observed for a single miner.
+type PeerTrackerRecord struct {
+	Successes             int
+	Failures              int
+	AverageBytesPerSecond uint64
+	LastTimeToFirstByte   time.Duration
+	UpdatedAt             time.Time
+}
+
+// PeerTracker is a small on-disk store of per-miner retrieval history,
+// analogous to Lotus's blocksync peer tracker: it remembers which miners have
+// been fast and reliable so that future candidate selection can be biased
+// toward them.
+type PeerTracker struct {
+	path string
+
+	mu      sync.Mutex
+	records map[string]*PeerTrackerRecord
+}
+
+// LoadPeerTracker reads a PeerTracker's records from path, or returns an
+// empty tracker if the file doesn't exist yet.
+func LoadPeerTracker(path string) (*PeerTracker, error) {
+	pt := &PeerTracker{path: path, records: map[string]*PeerTrackerRecord{}}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pt, nil
+	} else if err != nil {
+		return nil, xerrors.Errorf("failed to read peer tracker file %s: %w", path, err)
+	}
+
+	if err := json.Unmarshal(data, &pt.records); err != nil {
+		return nil, xerrors.Errorf("failed to parse peer tracker file %s: %w", path, err)
+	}
+
+	return pt, nil
+}
+
+// Save persists the tracker's current records to its backing file.
+func (pt *PeerTracker) Save() error {
+	pt.mu.Lock()
+	data, err := json.MarshalIndent(pt.records, "", "  ")
+	pt.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(pt.path, data, 0644); err != nil {
+		return xerrors.Errorf("failed to write peer tracker file %s: %w", pt.path, err)
+	}
+
+	return nil
+}
+
+// RecordSuccess updates miner's history after a successful retrieval and
+// persists the tracker, so the history survives into the next invocation of
+// the CLI (a fresh process, with a fresh in-memory PeerTracker, every time).
+func (pt *PeerTracker) RecordSuccess(miner address.Address, bytesPerSecond uint64, timeToFirstByte time.Duration) {
+	pt.mu.Lock()
+	r := pt.recordLocked(miner)
+	r.Successes++
+	// Simple exponential moving average, so a single unrepresentative
+	// transfer doesn't swing the score too far.
+	if r.AverageBytesPerSecond == 0 {
+		r.AverageBytesPerSecond = bytesPerSecond
+	} else {
+		r.AverageBytesPerSecond = (r.AverageBytesPerSecond + bytesPerSecond) / 2
+	}
+	r.LastTimeToFirstByte = timeToFirstByte
+	r.UpdatedAt = time.Now()
+	pt.mu.Unlock()
+
+	if err := pt.Save(); err != nil {
+		log.Warnf("failed to persist peer tracker to %s: %v", pt.path, err)
+	}
+}
+
+// RecordFailure updates miner's history after a failed retrieval attempt and
+// persists the tracker - see RecordSuccess.
+func (pt *PeerTracker) RecordFailure(miner address.Address) {
+	pt.mu.Lock()
+	r := pt.recordLocked(miner)
+	r.Failures++
+	r.UpdatedAt = time.Now()
+	pt.mu.Unlock()
+
+	if err := pt.Save(); err != nil {
+		log.Warnf("failed to persist peer tracker to %s: %v", pt.path, err)
+	}
+}
+
+func (pt *PeerTracker) recordLocked(miner address.Address) *PeerTrackerRecord {
+	key := miner.String()
+	r, ok := pt.records[key]
+	if !ok {
+		r = &PeerTrackerRecord{}
+		pt.records[key] = r
+	}
+	return r
+}
+
+// Get returns a copy of the tracked record for miner, or the zero value if
+// nothing has been recorded for it yet.
+func (pt *PeerTracker) Get(miner address.Address) PeerTrackerRecord {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if r, ok := pt.records[miner.String()]; ok {
+		return *r
+	}
+	return PeerTrackerRecord{}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"math"
+	"sort"
+	"strconv"
+
+	"github.com/filecoin-project/go-state-types/big"
+)
+
+// CandidateRankerWeights controls how much each signal that
+// weightedCandidateRanker considers contributes to a candidate's combined
+// score. Each weight is non-negative; 0 disables that signal entirely. The
+// zero value is not meant to be used directly - see
+// defaultCandidateRankerWeights.
+type CandidateRankerWeights struct {
+	// Price weighs the candidate's total cost (MinPricePerByte*Size +
+	// UnsealPrice). Increase to bias toward cheaper retrievals.
+	Price float64
+
+	// Reliability weighs the candidate's historical success rate, as
+	// tracked by a PeerTracker. Increase to bias toward miners that have
+	// reliably completed retrievals before.
+	Reliability float64
+
+	// Latency weighs the RTT observed for the candidate's retrieval query.
+	// Increase to bias toward geographically/topologically closer miners.
+	Latency float64
+}
+
+// defaultCandidateRankerWeights weighs price and provider reliability
+// equally, with query latency as a lighter tie-breaker.
+var defaultCandidateRankerWeights = CandidateRankerWeights{
+	Price:       1,
+	Reliability: 1,
+	Latency:     0.5,
+}
+
+// CandidateRanker orders a set of queried candidates from most to least
+// preferred, in place. It's consulted by tryRetrieveFromFIL once every
+// candidate has been queried, unless CandidateSelectionConfig.noSort is set.
+type CandidateRanker interface {
+	Rank(queries []candidateQuery)
+}
+
+// weightedCandidateRanker is the default CandidateRanker. It always prefers
+// unsealed candidates over sealed ones, no matter what else is true about
+// them, then breaks ties among the rest by min-max normalizing price, the
+// candidate miner's historical success rate (from a PeerTracker, if one was
+// supplied) and the RTT of its retrieval query onto a common [0, 1] scale and
+// combining them into a single weighted score.
+type weightedCandidateRanker struct {
+	weights     CandidateRankerWeights
+	peerTracker *PeerTracker
+}
+
+func newWeightedCandidateRanker(weights CandidateRankerWeights, peerTracker *PeerTracker) *weightedCandidateRanker {
+	return &weightedCandidateRanker{weights: weights, peerTracker: peerTracker}
+}
+
+func (r *weightedCandidateRanker) Rank(queries []candidateQuery) {
+	if len(queries) == 0 {
+		return
+	}
+
+	price := make([]float64, len(queries))
+	unreliability := make([]float64, len(queries))
+	latency := make([]float64, len(queries))
+	for i, q := range queries {
+		// Candidates with no FIL retrieval market query (HTTP/bitswap-only,
+		// e.g. from an indexer or the DHT) have no Response - they're free
+		// and unsealed by construction, so they score at the floor of the
+		// price and latency signals (zero cost, zero RTT); their
+		// reliability still comes from successRate like any other.
+		if q.Response != nil {
+			price[i] = bigIntToFloat64(totalCost(q.Response))
+		}
+		unreliability[i] = 1 - r.successRate(q)
+		latency[i] = float64(q.RTT)
+	}
+
+	priceNorm := normalize(price)
+	unreliabilityNorm := normalize(unreliability)
+	latencyNorm := normalize(latency)
+
+	type scoredQuery struct {
+		query    candidateQuery
+		unsealed bool
+		score    float64
+	}
+
+	scored := make([]scoredQuery, len(queries))
+	for i, q := range queries {
+		scored[i] = scoredQuery{
+			query:    q,
+			unsealed: q.Response == nil || q.Response.UnsealPrice.IsZero(),
+			score: r.weights.Price*priceNorm[i] +
+				r.weights.Reliability*unreliabilityNorm[i] +
+				r.weights.Latency*latencyNorm[i],
+		}
+	}
+
+	sort.SliceStable(scored, func(i, j int) bool {
+		if scored[i].unsealed != scored[j].unsealed {
+			return scored[i].unsealed
+		}
+		return scored[i].score < scored[j].score
+	})
+
+	for i, sq := range scored {
+		queries[i] = sq.query
+	}
+}
+
+// successRate returns q's candidate miner's historical success rate in
+// [0, 1], or 0.5 (neutral) if no history is available.
+func (r *weightedCandidateRanker) successRate(q candidateQuery) float64 {
+	if r.peerTracker == nil {
+		return 0.5
+	}
+
+	record := r.peerTracker.Get(q.Candidate.Miner)
+	total := record.Successes + record.Failures
+	if total == 0 {
+		return 0.5
+	}
+
+	return float64(record.Successes) / float64(total)
+}
+
+// normalize min-max scales xs onto [0, 1]. A signal that's identical across
+// every candidate (including a slice of length 1) is returned as all zeroes,
+// so it doesn't contribute to the combined score.
+func normalize(xs []float64) []float64 {
+	out := make([]float64, len(xs))
+
+	min, max := xs[0], xs[0]
+	for _, x := range xs[1:] {
+		min = math.Min(min, x)
+		max = math.Max(max, x)
+	}
+	if max == min {
+		return out
+	}
+
+	for i, x := range xs {
+		out[i] = (x - min) / (max - min)
+	}
+	return out
+}
+
+// bigIntToFloat64 converts a go-state-types/big.Int into a float64 for use
+// in the ranker's scoring - this loses precision on very large values, which
+// is fine here since the result only feeds a relative comparison, not
+// accounting.
+func bigIntToFloat64(x big.Int) float64 {
+	f, err := strconv.ParseFloat(x.String(), 64)
+	if err != nil {
+		return 0
+	}
+	return f
+}
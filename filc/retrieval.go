@@ -3,28 +3,27 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
-	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/application-research/filclient"
-	"github.com/application-research/filclient/retrievehelper"
 	"github.com/dustin/go-humanize"
 	"github.com/filecoin-project/go-address"
 	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
 	"github.com/filecoin-project/go-state-types/big"
 	"github.com/filecoin-project/lotus/chain/types"
-	"github.com/ipfs/go-blockservice"
 	"github.com/ipfs/go-cid"
-	ipldformat "github.com/ipfs/go-ipld-format"
-	"github.com/ipfs/go-merkledag"
 	"github.com/ipld/go-ipld-prime"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
 	"golang.org/x/term"
 	"golang.org/x/xerrors"
 )
@@ -33,6 +32,20 @@ type RetrievalCandidate struct {
 	Miner   address.Address
 	RootCid cid.Cid
 	DealID  uint
+
+	// PeerID identifies a non-SP candidate (HTTP/bitswap-only, e.g. from an
+	// indexer or the DHT) that has no Miner. It's what distinguishes two
+	// such candidates from one another when merging candidate lists - see
+	// mergeCandidates.
+	PeerID string
+
+	// Addrs and Protocols are optional: they let a candidate source (e.g. an
+	// indexer) advertise which TransportProtocols it supports and how to
+	// reach it over each. Candidates with no Protocols are assumed to support
+	// every transport (see supportsCandidate); HTTP and bitswap are still
+	// only tried when Addrs is also set.
+	Addrs     []multiaddr.Multiaddr
+	Protocols []multicodec.Code
 }
 
 type CandidateSelectionConfig struct {
@@ -42,8 +55,36 @@ type CandidateSelectionConfig struct {
 	// If true, candidates will be tried in the order they're passed in
 	// unchanged (and all other sorting-related options will be ignored)
 	noSort bool
+
+	// MaxConcurrentRetrievals bounds how many of the top-ranked candidates
+	// are raced against each other at once. <= 0 means a default of 3.
+	MaxConcurrentRetrievals int
+
+	// Per-phase timeouts. Zero means no timeout for that phase.
+	QueryTimeout     time.Duration
+	ConnectTimeout   time.Duration
+	FirstByteTimeout time.Duration
+	OverallTimeout   time.Duration
+
+	// PeerTracker, if set, records per-miner success/failure/speed history
+	// and is consulted when ranking candidates.
+	PeerTracker *PeerTracker
+
+	// Ranker orders queried candidates before they're raced. Nil means the
+	// default weightedCandidateRanker, configured with RankerWeights.
+	Ranker CandidateRanker
+
+	// RankerWeights tunes the default ranker. The zero value is replaced
+	// with defaultCandidateRankerWeights.
+	RankerWeights CandidateRankerWeights
+
+	// IndexerSource, if set, is queried alongside the caller-supplied
+	// candidates and merged in before ranking.
+	IndexerSource *IndexerCandidateSource
 }
 
+const defaultMaxConcurrentRetrievals = 3
+
 type RetrievalResults struct {
 }
 
@@ -112,17 +153,69 @@ func (stats *IPFSRetrievalStats) GetAverageBytesPerSecond() uint64 {
 	return uint64(float64(stats.ByteSize) / stats.Duration.Seconds())
 }
 
+// candidateQuery pairs a candidate with the transports (in preference order)
+// that it's worth trying it over.
+type candidateQuery struct {
+	Candidate  RetrievalCandidate
+	Response   *retrievalmarket.QueryResponse
+	Transports []TransportProtocol
+
+	// RTT is how long the retrieval query itself took, used by
+	// weightedCandidateRanker as a latency hint.
+	RTT time.Duration
+}
+
+// RetrieveFromBestCandidate fetches c from the best of candidates, according
+// to cfg. selNode, dagScope and outputPath are expected to be wired up by the
+// CLI's --selector/--dag-json-selector, --dag-scope and --output flags
+// respectively: selNode (or the default selector for dagScope, if selNode is
+// nil) restricts the traversal, and outputPath, if non-empty, causes the
+// retrieved DAG to be written directly into a CARv2 file at that path instead
+// of only being counted. eventCallback, if non-nil, receives a structured
+// RetrievalEvent stream for the whole attempt (see events.go); pass
+// NewPrometheusRetrievalEventCallback() to export it as Prometheus metrics.
 func (node *Node) RetrieveFromBestCandidate(
 	ctx context.Context,
 	fc *filclient.FilClient,
 	c cid.Cid,
 	selNode ipld.Node,
+	dagScope string,
+	outputPath string,
 	candidates []RetrievalCandidate,
 	cfg CandidateSelectionConfig,
+	eventCallback RetrievalEventCallback,
 ) (RetrievalStats, error) {
+	request := RetrievalRequest{
+		Root:       c,
+		Selector:   selNode,
+		DagScope:   dagScope,
+		OutputPath: outputPath,
+		Progress:   printProgress,
+		Events:     eventCallback,
+	}
+
+	emitEvent(request, RetrievalEventStarted, address.Undef, 0, 0, nil)
+
+	// Merge in candidates from any other sources we know about, beyond the
+	// ones the caller already looked up (typically from an estuary-style
+	// HTTP endpoint), so that tryRetrieveFromFIL can race across all of them
+	// using whichever transport each one actually advertised.
+	allCandidates := candidates
+	if cfg.IndexerSource != nil {
+		indexerCandidates, err := cfg.IndexerSource.GetRetrievalCandidates(ctx, c)
+		if err != nil {
+			log.Warnf("indexer candidate lookup for %s failed: %v", c, err)
+		} else {
+			allCandidates = mergeCandidates(allCandidates, indexerCandidates)
+		}
+	}
+	if cfg.tryIPFS {
+		allCandidates = mergeCandidates(allCandidates, node.dhtCandidates(ctx, c, cfg.ConnectTimeout))
+	}
+
 	// Try IPFS first, if requested
-	if cfg.tryIPFS && (selNode == nil || selNode.IsNull()) {
-		stats, err := node.tryRetrieveFromIPFS(ctx, c)
+	if cfg.tryIPFS {
+		stats, err := node.tryRetrieveFromIPFS(ctx, request)
 		if err != nil {
 			// If IPFS failed, log the error and continue to FIL attempt
 			log.Error(err) // TODO: handle errors specifically
@@ -131,24 +224,49 @@ func (node *Node) RetrieveFromBestCandidate(
 		}
 	}
 
-	stats, err := node.tryRetrieveFromFIL(ctx, fc, c, selNode, candidates, cfg)
+	stats, err := node.tryRetrieveFromFIL(ctx, fc, request, allCandidates, cfg)
 	if err != nil {
 		log.Error(err) // TODO
 	} else {
 		return stats, err
 	}
 
+	emitFailureEvent(request, address.Undef, 0, ReasonAllFailed, err)
 	return nil, fmt.Errorf("all retrieval attempts failed")
 }
 
+// tryRetrieveFromIPFS is a thin wrapper that drives an ipfsTransportProtocol
+// for the whole-DHT discovery path, where no candidate list is available.
+func (node *Node) tryRetrieveFromIPFS(ctx context.Context, request RetrievalRequest) (RetrievalStats, error) {
+	transport := newIPFSTransportProtocol(node)
+	candidate := RetrievalCandidate{RootCid: request.Root}
+
+	if err := transport.Connect(ctx, candidate, request); err != nil {
+		return nil, err
+	}
+	emitEvent(request, RetrievalEventConnected, address.Undef, transport.Code(), 0, nil)
+
+	stats, err := transport.Retrieve(ctx, request)
+	if err != nil {
+		reason := ReasonRetrieveFailed
+		if errors.Is(err, ErrSelectorMismatch) {
+			reason = ReasonSelectorMismatch
+		}
+		emitFailureEvent(request, address.Undef, transport.Code(), reason, err)
+		return nil, err
+	}
+
+	emitEvent(request, RetrievalEventSuccess, address.Undef, transport.Code(), stats.GetByteSize(), nil)
+	return stats, nil
+}
+
 func (node *Node) tryRetrieveFromFIL(
 	ctx context.Context,
 	fc *filclient.FilClient,
-	c cid.Cid,
-	selNode ipld.Node,
+	request RetrievalRequest,
 	candidates []RetrievalCandidate,
 	cfg CandidateSelectionConfig,
-) (*FILRetrievalStats, error) {
+) (RetrievalStats, error) {
 
 	// If no miners are provided, there's nothing else we can do
 	if len(candidates) == 0 {
@@ -156,17 +274,13 @@ func (node *Node) tryRetrieveFromFIL(
 		return nil, xerrors.Errorf("retrieval failed: no miners were provided")
 	}
 
-	// If IPFS retrieval was unavailable, do a full FIL retrieval. Start with
-	// querying all the candidates for sorting.
-
+	// Query every candidate (for sorting purposes) and work out which
+	// transports it's worth trying against each one, based on what it
+	// advertised.
 	log.Info("Querying FIL retrieval candidates...")
 
-	type CandidateQuery struct {
-		Candidate RetrievalCandidate
-		Response  *retrievalmarket.QueryResponse
-	}
 	checked := 0
-	var queries []CandidateQuery
+	var queries []candidateQuery
 	var queriesLk sync.Mutex
 
 	var wg sync.WaitGroup
@@ -180,14 +294,47 @@ func (node *Node) tryRetrieveFromFIL(
 		go func() {
 			defer wg.Done()
 
-			query, err := fc.RetrievalQuery(ctx, candidate.Miner, candidate.RootCid)
+			// Candidates with no miner address (HTTP/bitswap-only, sourced
+			// from an indexer or the DHT) have no FIL retrieval market to
+			// query - send them straight into the race with whatever
+			// transports they already advertised, instead of failing
+			// fc.RetrievalQuery on an undefined address.
+			if candidate.Miner == address.Undef {
+				transports := transportsForCandidate(fc, node, candidate, nil)
+				if len(transports) == 0 {
+					return
+				}
+
+				queriesLk.Lock()
+				queries = append(queries, candidateQuery{Candidate: candidate, Transports: transports})
+				checked++
+				fmt.Fprintf(os.Stderr, "%v/%v\r", checked, len(candidates))
+				queriesLk.Unlock()
+				return
+			}
+
+			queryCtx := ctx
+			if cfg.QueryTimeout > 0 {
+				var cancel context.CancelFunc
+				queryCtx, cancel = context.WithTimeout(ctx, cfg.QueryTimeout)
+				defer cancel()
+			}
+
+			queryStart := time.Now()
+			query, err := fc.RetrievalQuery(queryCtx, candidate.Miner, candidate.RootCid)
 			if err != nil {
 				log.Debugf("Retrieval query for miner %s failed: %v", candidate.Miner, err)
 				return
 			}
+			rtt := time.Since(queryStart)
 
 			queriesLk.Lock()
-			queries = append(queries, CandidateQuery{Candidate: candidate, Response: query})
+			queries = append(queries, candidateQuery{
+				Candidate:  candidate,
+				Response:   query,
+				Transports: transportsForCandidate(fc, node, candidate, query),
+				RTT:        rtt,
+			})
 			checked++
 			fmt.Fprintf(os.Stderr, "%v/%v\r", checked, len(candidates))
 			queriesLk.Unlock()
@@ -202,159 +349,393 @@ func (node *Node) tryRetrieveFromFIL(
 		return nil, xerrors.Errorf("retrieval failed: queries failed for all miners")
 	}
 
-	// After we got the query results, sort them with respect to the candidate
-	// selection config as long as noSort isn't requested (TODO - more options)
+	// After we got the query results, rank them with respect to the
+	// candidate selection config as long as noSort isn't requested.
 
 	if !cfg.noSort {
-		sort.Slice(queries, func(i, j int) bool {
-			a := queries[i].Response
-			b := queries[i].Response
-
-			// Always prefer unsealed to sealed, no matter what
-			if a.UnsealPrice.IsZero() && !b.UnsealPrice.IsZero() {
-				return true
+		ranker := cfg.Ranker
+		if ranker == nil {
+			weights := cfg.RankerWeights
+			if weights == (CandidateRankerWeights{}) {
+				weights = defaultCandidateRankerWeights
 			}
+			ranker = newWeightedCandidateRanker(weights, cfg.PeerTracker)
+		}
+		ranker.Rank(queries)
+	}
+
+	// Race up to MaxConcurrentRetrievals of the top-ranked candidates at
+	// once, starting the next-ranked candidate whenever an attempt in flight
+	// finishes without success. Once any one
+	// candidate delivers its first block, it's overwhelmingly likely to be
+	// the one that finishes, so the other attempts already in flight are
+	// cancelled right then rather than left running for the whole duration
+	// of the winner's transfer - but candidates still queued behind
+	// maxConcurrent are left alone, so they still get a chance to run if the
+	// presumed winner ends up failing anyway.
+	maxConcurrent := cfg.MaxConcurrentRetrievals
+	if maxConcurrent <= 0 {
+		maxConcurrent = defaultMaxConcurrentRetrievals
+	}
+
+	raceCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	if cfg.OverallTimeout > 0 {
+		var overallCancel context.CancelFunc
+		raceCtx, overallCancel = context.WithTimeout(raceCtx, cfg.OverallTimeout)
+		defer overallCancel()
+	}
 
-			// Select lower price, or continue if equal
-			aTotalPrice := totalCost(a)
-			bTotalPrice := totalCost(b)
-			if !aTotalPrice.Equals(bTotalPrice) {
-				return aTotalPrice.LessThan(bTotalPrice)
+	type raceResult struct {
+		i     int
+		stats RetrievalStats
+		err   error
+	}
+
+	// Each attempt gets its own context, derived from raceCtx, so that
+	// cancelling the losers when one attempt reports first byte doesn't also
+	// cancel that attempt's own in-flight transfer.
+	attemptCtxs := make([]context.Context, len(queries))
+	attemptCancels := make([]context.CancelFunc, len(queries))
+	for i := range queries {
+		attemptCtxs[i], attemptCancels[i] = context.WithCancel(raceCtx)
+	}
+
+	// started tracks which attempts have actually begun competing for
+	// bandwidth (past the sem acquisition below), as opposed to ones still
+	// queued behind maxConcurrent. cancelOtherAttempts only cancels the
+	// former: a queued attempt hasn't cost anything yet, and needs to be
+	// left alone so it can carry on in its place if the presumed winner
+	// turns out to fail after all.
+	started := make([]bool, len(queries))
+	var startedMu sync.Mutex
+
+	// winner records which attempt's first byte triggered
+	// cancelOtherAttempts, so the result loop below can tell "the winner
+	// itself failed" apart from "a loser we deliberately cancelled reported
+	// context.Canceled", and report the former as the real failure reason
+	// instead of whichever of the two happens to be read off results last.
+	winner := -1
+	var winnerMu sync.Mutex
+
+	var firstByteOnce sync.Once
+	cancelOtherAttempts := func(winnerIdx int) {
+		firstByteOnce.Do(func() {
+			winnerMu.Lock()
+			winner = winnerIdx
+			winnerMu.Unlock()
+
+			startedMu.Lock()
+			defer startedMu.Unlock()
+			for i, attemptCancel := range attemptCancels {
+				if i != winnerIdx && started[i] {
+					attemptCancel()
+				}
 			}
+		})
+	}
+
+	results := make(chan raceResult, len(queries))
+	sem := make(chan struct{}, maxConcurrent)
 
-			// Select smaller size, or continue if equal
-			if a.Size != b.Size {
-				return a.Size < b.Size
+	// turns[i] is closed once attempt i-1 has claimed its sem slot (or given
+	// up), so that attempts claim slots strictly in rank order.
+	turns := make([]chan struct{}, len(queries)+1)
+	for i := range turns {
+		turns[i] = make(chan struct{})
+	}
+	close(turns[0])
+
+	var attempts sync.WaitGroup
+	attempts.Add(len(queries))
+	for i, query := range queries {
+		i, query := i, query
+		go func() {
+			defer attempts.Done()
+			defer attemptCancels[i]()
+
+			select {
+			case <-turns[i]:
+			case <-attemptCtxs[i].Done():
+			}
+			select {
+			case sem <- struct{}{}:
+				close(turns[i+1])
+			case <-attemptCtxs[i].Done():
+				close(turns[i+1])
+				results <- raceResult{i: i, err: attemptCtxs[i].Err()}
+				return
 			}
+			defer func() { <-sem }()
 
-			return false
-		})
+			startedMu.Lock()
+			started[i] = true
+			startedMu.Unlock()
+
+			stats, err := node.tryRetrieveFromCandidate(attemptCtxs[i], query, request, cfg, func() { cancelOtherAttempts(i) })
+			results <- raceResult{i: i, stats: stats, err: err}
+		}()
 	}
 
-	// Now attempt retrievals in serial from first to last, until one works.
-	// stats will get set if a retrieval succeeds - if no retrievals work, it
-	// will still be nil after the loop finishes
-	var stats *FILRetrievalStats = nil
-	for _, query := range queries {
-		log.Infof("Attempting FIL retrieval with miner %s from root CID %s (%s)", query.Candidate.Miner, query.Candidate.RootCid, types.FIL(totalCost(query.Response)))
+	go func() {
+		attempts.Wait()
+		close(results)
+	}()
 
-		if selNode != nil && !selNode.IsNull() {
-			log.Infof("Using selector %s", selNode)
+	var lastErr, winnerErr error
+	for result := range results {
+		if result.err == nil {
+			cancel() // stop any still-running losers
+			log.Info("FIL retrieval succeeded")
+			return result.stats, nil
 		}
 
-		proposal, err := retrievehelper.RetrievalProposalForAsk(query.Response, query.Candidate.RootCid, selNode)
-		if err != nil {
-			log.Debugf("Failed to create retrieval proposal with candidate miner %s: %v", query.Candidate.Miner, err)
+		winnerMu.Lock()
+		isWinner := result.i == winner
+		hasWinner := winner >= 0
+		winnerMu.Unlock()
+
+		switch {
+		case isWinner:
+			// The presumed winner failed after all - that's the real reason
+			// the race didn't produce anything, not whatever
+			// context.Canceled a deliberately-cancelled loser reports.
+			winnerErr = result.err
+		case hasWinner && errors.Is(result.err, context.Canceled):
+			// Cancelled as a loser once the winner reported first byte, not
+			// a genuine failure - don't let it clobber a real error.
+		default:
+			lastErr = result.err
+		}
+	}
+
+	if winnerErr != nil {
+		return nil, winnerErr
+	}
+	if lastErr == nil {
+		lastErr = xerrors.New("retrieval failed for all miners")
+	}
+	return nil, lastErr
+}
+
+// tryRetrieveFromCandidate attempts query's transports in order, applying
+// cfg's connect/first-byte timeouts and recording the outcome in
+// cfg.PeerTracker (if set). onFirstByte, if non-nil, is called the moment
+// the first block of an attempt arrives, whether or not that attempt goes on
+// to succeed - tryRetrieveFromFIL uses
+// it to cancel the rest of the race rather than waiting for this attempt to
+// fully finish.
+func (node *Node) tryRetrieveFromCandidate(ctx context.Context, query candidateQuery, request RetrievalRequest, cfg CandidateSelectionConfig, onFirstByte func()) (RetrievalStats, error) {
+	var lastErr error
+
+	for _, transport := range query.Transports {
+		if query.Response != nil {
+			log.Infof("Attempting %v retrieval with miner %s from root CID %s (%s)", transport.Code(), query.Candidate.Miner, query.Candidate.RootCid, types.FIL(totalCost(query.Response)))
+		} else {
+			log.Infof("Attempting %v retrieval from root CID %s", transport.Code(), query.Candidate.RootCid)
+		}
+
+		if request.Selector != nil && !request.Selector.IsNull() {
+			log.Infof("Using selector %s", request.Selector)
+		}
+
+		connectCtx := ctx
+		if cfg.ConnectTimeout > 0 {
+			var cancel context.CancelFunc
+			connectCtx, cancel = context.WithTimeout(ctx, cfg.ConnectTimeout)
+			defer cancel()
+		}
+
+		if err := transport.Connect(connectCtx, query.Candidate, request); err != nil {
+			log.Debugf("Failed to connect to candidate miner %s over %v: %v", query.Candidate.Miner, transport.Code(), err)
+			lastErr = err
+			emitFailureEvent(request, query.Candidate.Miner, transport.Code(), ReasonConnectFailed, err)
 			continue
 		}
+		emitEvent(request, RetrievalEventConnected, query.Candidate.Miner, transport.Code(), 0, nil)
+
+		retrieveCtx := ctx
+		var firstByteTimer *time.Timer
+		if cfg.FirstByteTimeout > 0 {
+			var cancel context.CancelFunc
+			retrieveCtx, cancel = context.WithCancel(ctx)
+			firstByteTimer = time.AfterFunc(cfg.FirstByteTimeout, cancel)
+		}
 
-		var bytesReceived uint64
-		stats_, err := fc.RetrieveContentWithProgressCallback(ctx, query.Candidate.Miner, proposal, func(bytesReceived_ uint64) {
-			bytesReceived = bytesReceived_
-			printProgress(bytesReceived)
-		})
+		start := time.Now()
+		var firstByteOnce sync.Once
+		var timeToFirstByte time.Duration
+
+		reqForAttempt := request
+		reqForAttempt.Progress = func(bytesReceived uint64) {
+			firstByteOnce.Do(func() {
+				timeToFirstByte = time.Since(start)
+				if firstByteTimer != nil {
+					firstByteTimer.Stop()
+				}
+				emitEvent(request, RetrievalEventFirstByte, query.Candidate.Miner, transport.Code(), bytesReceived, nil)
+				if onFirstByte != nil {
+					onFirstByte()
+				}
+			})
+			if request.Progress != nil {
+				request.Progress(bytesReceived)
+			}
+		}
+
+		stats, err := transport.Retrieve(retrieveCtx, reqForAttempt)
 		if err != nil {
-			log.Errorf("Failed to retrieve content with candidate miner %s: %v", query.Candidate.Miner, err)
+			log.Errorf("Failed to retrieve content with candidate miner %s over %v: %v", query.Candidate.Miner, transport.Code(), err)
+			lastErr = err
+			reason := ReasonRetrieveFailed
+			if errors.Is(err, ErrSelectorMismatch) {
+				reason = ReasonSelectorMismatch
+			}
+			emitFailureEvent(request, query.Candidate.Miner, transport.Code(), reason, err)
+			if cfg.PeerTracker != nil {
+				cfg.PeerTracker.RecordFailure(query.Candidate.Miner)
+			}
 			continue
 		}
 
-		stats = &FILRetrievalStats{RetrievalStats: *stats_}
-		break
+		if cfg.PeerTracker != nil {
+			cfg.PeerTracker.RecordSuccess(query.Candidate.Miner, stats.GetAverageBytesPerSecond(), timeToFirstByte)
+		}
+
+		emitEvent(request, RetrievalEventSuccess, query.Candidate.Miner, transport.Code(), stats.GetByteSize(), nil)
+		return stats, nil
+	}
+
+	if lastErr == nil {
+		lastErr = xerrors.Errorf("no transports available for candidate %s", query.Candidate.Miner)
 	}
+	return nil, lastErr
+}
 
-	if stats == nil {
-		return nil, xerrors.New("retrieval failed for all miners")
+// transportsForCandidate returns the TransportProtocols worth trying against
+// a candidate, in preference order. HTTP is preferred when advertised, since
+// it doesn't require a paid deal; graphsync-over-FIL is included as a
+// fallback for every candidate with a miner address, and left out for
+// candidates without one. query, if non-nil, is the retrieval query response the caller
+// already got back for candidate, and is threaded into the FIL transport so
+// it doesn't have to query the same miner again in Connect.
+func transportsForCandidate(fc *filclient.FilClient, node *Node, candidate RetrievalCandidate, query *retrievalmarket.QueryResponse) []TransportProtocol {
+	var transports []TransportProtocol
+
+	httpTransport := newHTTPTransportProtocol(node)
+	if supportsCandidate(httpTransport, candidate) && len(candidate.Addrs) > 0 {
+		transports = append(transports, httpTransport)
 	}
 
-	log.Info("FIL retrieval succeeded")
+	ipfsTransport := newIPFSTransportProtocol(node)
+	if supportsCandidate(ipfsTransport, candidate) && len(candidate.Addrs) > 0 {
+		transports = append(transports, ipfsTransport)
+	}
 
-	return stats, nil
+	// A candidate with no miner address (e.g. one sourced purely from the
+	// DHT or an indexer entry with no FIL deal) has nothing for a retrieval
+	// query to be asked of.
+	if candidate.Miner != address.Undef {
+		transports = append(transports, newFILTransportProtocol(fc, node, query))
+	}
+
+	return transports
 }
 
-func (node *Node) tryRetrieveFromIPFS(ctx context.Context, c cid.Cid) (*IPFSRetrievalStats, error) {
-	log.Info("Searching IPFS for CID...")
+// mergeCandidates combines candidate lists from multiple sources (the
+// caller-supplied list, an IndexerCandidateSource, the local DHT, ...) into
+// one, deduplicating by (Miner, PeerID, RootCid) and unioning the Addrs/
+// Protocols advertised for a given candidate by more than one source. PeerID
+// is part of the key because most non-SP candidates (HTTP/bitswap-only) share
+// the same zero Miner - keying on Miner alone would collapse unrelated
+// providers into a single candidate and mix their addresses together.
+func mergeCandidates(sources ...[]RetrievalCandidate) []RetrievalCandidate {
+	type key struct {
+		miner  address.Address
+		peerID string
+		root   cid.Cid
+	}
 
-	providers := node.DHT.FindProvidersAsync(ctx, c, 20)
+	var order []key
+	merged := map[key]*RetrievalCandidate{}
 
-	ready := make(chan bool, 1)
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case provider := <-providers:
-				if provider.ID == "" {
-					continue
-				}
+	for _, candidates := range sources {
+		for _, candidate := range candidates {
+			k := key{candidate.Miner, candidate.PeerID, candidate.RootCid}
 
-				log.Infof("Provider candidate %s", provider)
-
-				if err := node.Host.Connect(ctx, provider); err != nil {
-					log.Warnf("Failed to connect to IPFS provider %s: %v", provider, err)
-					continue
-				}
+			existing, ok := merged[k]
+			if !ok {
+				c := candidate
+				merged[k] = &c
+				order = append(order, k)
+				continue
+			}
 
-				log.Infof("Connected to IPFS provider %s", provider)
-				ready <- true
+			existing.Addrs = append(existing.Addrs, candidate.Addrs...)
+			existing.Protocols = mergeProtocols(existing.Protocols, candidate.Protocols)
+			if existing.DealID == 0 {
+				existing.DealID = candidate.DealID
 			}
 		}
-	}()
-
-	select {
-	// TODO: also add connection timeout
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-ready:
-		// All we do on ready is stop blocking
 	}
 
-	// If we were able to connect to at least one of the providers, go ahead
-	// with the retrieval
+	out := make([]RetrievalCandidate, 0, len(order))
+	for _, k := range order {
+		out = append(out, *merged[k])
+	}
+	return out
+}
 
-	var progressLk sync.Mutex
-	var bytesRetrieved uint64 = 0
-	startTime := time.Now()
+// mergeProtocols unions two Protocols lists, preserving a's ordering and
+// appending whichever of b's codes aren't already present in a.
+func mergeProtocols(a, b []multicodec.Code) []multicodec.Code {
+	seen := make(map[multicodec.Code]bool, len(a))
+	for _, code := range a {
+		seen[code] = true
+	}
 
-	log.Info("Starting IPFS retrieval")
+	for _, code := range b {
+		if !seen[code] {
+			a = append(a, code)
+			seen[code] = true
+		}
+	}
 
-	bserv := blockservice.New(node.Blockstore, node.Bitswap)
-	dserv := merkledag.NewDAGService(bserv)
-	//dsess := dserv.Session(ctx)
+	return a
+}
 
-	cset := cid.NewSet()
-	if err := merkledag.Walk(ctx, func(ctx context.Context, c cid.Cid) ([]*ipldformat.Link, error) {
-		node, err := dserv.Get(ctx, c)
-		if err != nil {
-			return nil, err
-		}
+// dhtCandidates does a best-effort DHT provider lookup for c, returning one
+// bitswap-only RetrievalCandidate per distinct peer that responds within
+// timeout. A lookup that turns up nothing is business as usual, not a
+// failure worth aborting the overall retrieval for, so this never returns an
+// error.
+func (node *Node) dhtCandidates(ctx context.Context, c cid.Cid, timeout time.Duration) []RetrievalCandidate {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	dhtCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
 
-		// Only count leaf nodes toward the total size
-		if len(node.Links()) == 0 {
-			progressLk.Lock()
-			nodeSize, err := node.Size()
-			if err != nil {
-				nodeSize = 0
-			}
-			bytesRetrieved += nodeSize
-			printProgress(bytesRetrieved)
-			progressLk.Unlock()
+	var candidates []RetrievalCandidate
+	for provider := range node.DHT.FindProvidersAsync(dhtCtx, c, 20) {
+		if provider.ID == "" {
+			continue
 		}
 
-		if c.Type() == cid.Raw {
-			return nil, nil
+		addrs, err := peer.AddrInfoToP2pAddrs(&provider)
+		if err != nil {
+			continue
 		}
 
-		return node.Links(), nil
-	}, c, cset.Visit, merkledag.Concurrent()); err != nil {
-		return nil, err
+		candidates = append(candidates, RetrievalCandidate{
+			RootCid:   c,
+			PeerID:    provider.ID.String(),
+			Addrs:     addrs,
+			Protocols: []multicodec.Code{multicodec.TransportBitswap},
+		})
 	}
 
-	log.Info("IPFS retrieval succeeded")
-
-	return &IPFSRetrievalStats{
-		ByteSize: bytesRetrieved,
-		Duration: time.Since(startTime),
-	}, nil
+	return candidates
 }
 
 func totalCost(qres *retrievalmarket.QueryResponse) big.Int {
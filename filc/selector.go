@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	dagpb "github.com/ipld/go-codec-dagpb"
+	carv2 "github.com/ipld/go-car/v2"
+	carblockstore "github.com/ipld/go-car/v2/blockstore"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/ipld/go-ipld-prime/codec/dagjson"
+	"github.com/ipld/go-ipld-prime/linking"
+	cidlink "github.com/ipld/go-ipld-prime/linking/cid"
+	basicnode "github.com/ipld/go-ipld-prime/node/basic"
+	"github.com/ipld/go-ipld-prime/traversal"
+	"github.com/ipld/go-ipld-prime/traversal/selector"
+	"github.com/ipld/go-ipld-prime/traversal/selector/builder"
+	textselector "github.com/ipld/go-ipld-selector-text-lite"
+	"golang.org/x/xerrors"
+)
+
+// ParseSelector turns either a text-selector expression (as understood by
+// go-ipld-selector-text-lite) or a raw DAG-JSON encoded selector into the
+// ipld.Node form used throughout the retrieval path. At most one of text or
+// dagJSON should be non-empty; if both are empty, nil is returned, meaning
+// "retrieve the whole DAG".
+func ParseSelector(text string, dagJSON string) (ipld.Node, error) {
+	switch {
+	case text != "" && dagJSON != "":
+		return nil, xerrors.New("only one of a text selector or a DAG-JSON selector may be given")
+	case text != "":
+		spec, err := textselector.SelectorSpecFromPath(textselector.Expression(text), false, nil)
+		if err != nil {
+			return nil, xerrors.Errorf("failed to parse text selector %q: %w", text, err)
+		}
+		return spec.Node(), nil
+	case dagJSON != "":
+		nb := basicnode.Prototype.Any.NewBuilder()
+		if err := dagjson.Decode(nb, bytes.NewReader([]byte(dagJSON))); err != nil {
+			return nil, xerrors.Errorf("failed to decode DAG-JSON selector: %w", err)
+		}
+		return nb.Build(), nil
+	default:
+		return nil, nil
+	}
+}
+
+// defaultSelectorForDagScope builds the selector used when a request doesn't
+// supply one of its own, honoring the requested dag-scope in the same way as
+// the dag-scope query parameter on trustless HTTP gateways.
+func defaultSelectorForDagScope(dagScope string) (ipld.Node, error) {
+	ssb := builder.NewSelectorSpecBuilder(basicnode.Prototype.Any)
+
+	switch dagScope {
+	case "", "all":
+		return ssb.ExploreRecursive(selector.RecursionLimitNone(), ssb.ExploreAll(ssb.ExploreRecursiveEdge())).Node(), nil
+	case "entity":
+		return ssb.ExploreInterpretAs("unixfs", ssb.ExploreUnion(
+			ssb.Matcher(),
+			ssb.ExploreAll(ssb.ExploreRecursiveEdge()),
+		)).Node(), nil
+	case "block":
+		return ssb.Matcher().Node(), nil
+	default:
+		return nil, xerrors.Errorf("unrecognized dag-scope %q", dagScope)
+	}
+}
+
+// resolveSelector returns selNode if one was given, otherwise the default
+// selector for dagScope.
+func resolveSelector(selNode ipld.Node, dagScope string) (ipld.Node, error) {
+	if selNode != nil && !selNode.IsNull() {
+		return selNode, nil
+	}
+	return defaultSelectorForDagScope(dagScope)
+}
+
+// openCAROutput opens (creating if necessary) a CARv2 file at path as a
+// read/write blockstore rooted at root, so retrieved blocks can be written
+// directly into the output file as they arrive instead of only being counted.
+func openCAROutput(path string, root cid.Cid) (*carblockstore.ReadWrite, error) {
+	bs, err := carblockstore.OpenReadWrite(path, []cid.Cid{root}, carv2.ZeroLengthSectionAsEOF(true))
+	if err != nil {
+		return nil, xerrors.Errorf("failed to open CAR output %s: %w", path, err)
+	}
+	return bs, nil
+}
+
+// prototypeForCid picks the ipld-prime node prototype needed to decode a
+// block of the given CID's codec.
+func prototypeForCid(c cid.Cid) (ipld.NodePrototype, error) {
+	switch c.Prefix().Codec {
+	case cid.DagProtobuf:
+		return dagpb.Type.PBNode, nil
+	case cid.DagCBOR, cid.DagJSON:
+		return basicnode.Prototype.Any, nil
+	default:
+		return nil, xerrors.Errorf("no selector-traversal support for CID codec %d", c.Prefix().Codec)
+	}
+}
+
+// walkSelector traverses root according to sel, fetching blocks with fetch
+// and (if target is non-nil) writing every visited block into target as it's
+// read. It reports cumulative bytes visited via cb and returns the total.
+func walkSelector(
+	ctx context.Context,
+	root cid.Cid,
+	sel ipld.Node,
+	fetch func(ctx context.Context, c cid.Cid) (blocks.Block, error),
+	target blockstore.Blockstore,
+	cb ProgressCallback,
+) (uint64, error) {
+	var total uint64
+
+	lsys := cidlink.DefaultLinkSystem()
+	lsys.StorageReadOpener = func(lctx linking.LinkContext, lnk ipld.Link) (io.Reader, error) {
+		cl, ok := lnk.(cidlink.Link)
+		if !ok {
+			return nil, xerrors.Errorf("unexpected link type %T", lnk)
+		}
+
+		blk, err := fetch(lctx.Ctx, cl.Cid)
+		if err != nil {
+			return nil, err
+		}
+
+		if target != nil {
+			if err := target.Put(lctx.Ctx, blk); err != nil {
+				return nil, err
+			}
+		}
+
+		total += uint64(len(blk.RawData()))
+		cb(total)
+
+		return bytes.NewReader(blk.RawData()), nil
+	}
+
+	prototype, err := prototypeForCid(root)
+	if err != nil {
+		return 0, err
+	}
+
+	rootNode, err := lsys.Load(linking.LinkContext{Ctx: ctx}, cidlink.Link{Cid: root}, prototype)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to load root %s: %w", root, err)
+	}
+
+	compiledSel, err := selector.CompileSelector(sel)
+	if err != nil {
+		return 0, xerrors.Errorf("failed to compile selector: %w", err)
+	}
+
+	progress := traversal.Progress{Cfg: &traversal.Config{Ctx: ctx, LinkSystem: lsys}}
+	if err := progress.WalkMatching(rootNode, compiledSel, func(traversal.Progress, ipld.Node) error {
+		return nil
+	}); err != nil {
+		return total, err
+	}
+
+	return total, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+
+	"github.com/ipfs/go-cid"
+	"github.com/ipld/go-ipld-prime"
+	"github.com/multiformats/go-multicodec"
+	"golang.org/x/xerrors"
+)
+
+// ErrSelectorMismatch indicates a TransportProtocol's response didn't
+// actually satisfy the requested selector/dag-scope (e.g. a trustless
+// gateway returned the wrong scope, or extra/missing blocks). A
+// TransportProtocol wraps it into the error Retrieve returns so that
+// callers can tell a selector violation apart from a generic transport
+// failure - see tryRetrieveFromCandidate in retrieval.go.
+var ErrSelectorMismatch = xerrors.New("retrieved content did not satisfy the requested selector")
+
+// RetrievalRequest describes the content a TransportProtocol is being asked
+// to fetch.
+//
+// Selector, DagScope and OutputPath hold what a CLI's
+// --selector/--dag-json-selector, --dag-scope and --output flags would pass
+// to (*Node).RetrieveFromBestCandidate, which builds the RetrievalRequest
+// from them - see that function's doc comment. This repo's current slice has no main.go/CLI
+// entrypoint for those flags to live in, so the flag wiring itself hasn't
+// been added; only the library-side plumbing below exists so far.
+type RetrievalRequest struct {
+	Root cid.Cid
+
+	// Selector restricts the traversal to part of the DAG under Root (e.g. a
+	// single UnixFS subpath or block). Nil means "follow DagScope instead".
+	Selector ipld.Node
+
+	// DagScope mirrors the dag-scope parameter of trustless HTTP gateways
+	// ("all", "entity" or "block") and is used to pick a default selector
+	// when Selector is nil.
+	DagScope string
+
+	// OutputPath, if set, causes retrieved blocks to be written directly
+	// into a CARv2 file at this path instead of only being counted.
+	OutputPath string
+
+	// Progress, if set, is invoked as bytes are received.
+	Progress ProgressCallback
+
+	// Events, if set, is invoked with structured RetrievalEvents as the
+	// attempt progresses (see events.go).
+	Events RetrievalEventCallback
+}
+
+// ProgressCallback is invoked by a TransportProtocol as bytes are received,
+// mirroring the callback already used by fc.RetrieveContentWithProgressCallback.
+type ProgressCallback func(bytesReceived uint64)
+
+// TransportProtocol is a single retrieval mechanism (graphsync-over-FIL,
+// bitswap-over-libp2p, HTTP, ...) that knows how to connect to a candidate
+// and pull a CID's DAG down into the local blockstore. RetrieveFromBestCandidate
+// uses this interface to race/fall-back between transports without caring how
+// any one of them actually moves bytes.
+type TransportProtocol interface {
+	// Code identifies the transport as advertised by an indexer, so that
+	// candidates can be matched against the protocols they support.
+	Code() multicodec.Code
+
+	// Connect establishes whatever is needed (libp2p connection, HTTP
+	// reachability check, ...) to retrieve from the given candidate.
+	Connect(ctx context.Context, candidate RetrievalCandidate, request RetrievalRequest) error
+
+	// Retrieve pulls the requested content from the candidate previously
+	// passed to Connect, reporting progress and events via request.Progress
+	// and request.Events.
+	Retrieve(ctx context.Context, request RetrievalRequest) (RetrievalStats, error)
+}
+
+// supportsCandidate reports whether a candidate has advertised the protocol's
+// code. Candidates with no advertised protocols (e.g. from the legacy estuary
+// endpoint) are assumed to support every transport, since we have no way to
+// know otherwise.
+func supportsCandidate(t TransportProtocol, candidate RetrievalCandidate) bool {
+	if len(candidate.Protocols) == 0 {
+		return true
+	}
+
+	for _, code := range candidate.Protocols {
+		if code == t.Code() {
+			return true
+		}
+	}
+
+	return false
+}
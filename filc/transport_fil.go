@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+
+	"github.com/application-research/filclient"
+	"github.com/application-research/filclient/retrievehelper"
+	"github.com/filecoin-project/go-address"
+	"github.com/filecoin-project/go-fil-markets/retrievalmarket"
+	blocks "github.com/ipfs/go-block-format"
+	"github.com/ipfs/go-cid"
+	"github.com/multiformats/go-multicodec"
+	"golang.org/x/xerrors"
+)
+
+// filTransportProtocol retrieves content from a storage provider over
+// graphsync, using a paid or free retrieval deal. One instance is good for a
+// single candidate: Connect queries the miner (unless a query response was
+// already supplied) and builds a proposal, Retrieve then executes it.
+type filTransportProtocol struct {
+	fc   *filclient.FilClient
+	node *Node
+
+	// query is the response tryRetrieveFromFIL's query loop already got back
+	// from candidate.Miner when it queried every candidate for ranking
+	// purposes. Reusing it here means Connect doesn't have to ask the same
+	// miner the same question a second time.
+	query *retrievalmarket.QueryResponse
+
+	miner    address.Address
+	proposal *retrievalmarket.DealProposal
+}
+
+func newFILTransportProtocol(fc *filclient.FilClient, node *Node, query *retrievalmarket.QueryResponse) *filTransportProtocol {
+	return &filTransportProtocol{fc: fc, node: node, query: query}
+}
+
+func (t *filTransportProtocol) Code() multicodec.Code {
+	return multicodec.TransportGraphsyncFilecoinv1
+}
+
+func (t *filTransportProtocol) Connect(ctx context.Context, candidate RetrievalCandidate, request RetrievalRequest) error {
+	query := t.query
+	if query == nil {
+		var err error
+		query, err = t.fc.RetrievalQuery(ctx, candidate.Miner, candidate.RootCid)
+		if err != nil {
+			return xerrors.Errorf("retrieval query for miner %s failed: %w", candidate.Miner, err)
+		}
+	}
+	emitEvent(request, RetrievalEventQueryAsked, candidate.Miner, t.Code(), 0, nil)
+
+	proposal, err := retrievehelper.RetrievalProposalForAsk(query, candidate.RootCid, request.Selector)
+	if err != nil {
+		return xerrors.Errorf("failed to create retrieval proposal with candidate miner %s: %w", candidate.Miner, err)
+	}
+	emitEvent(request, RetrievalEventProposed, candidate.Miner, t.Code(), 0, nil)
+
+	t.miner = candidate.Miner
+	t.proposal = proposal
+
+	return nil
+}
+
+func (t *filTransportProtocol) Retrieve(ctx context.Context, request RetrievalRequest) (RetrievalStats, error) {
+	stats, err := t.fc.RetrieveContentWithProgressCallback(ctx, t.miner, t.proposal, func(bytesReceived uint64) {
+		if request.Progress != nil {
+			request.Progress(bytesReceived)
+		}
+		emitEvent(request, RetrievalEventBlockReceived, t.miner, t.Code(), bytesReceived, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Graphsync retrieval lands its blocks in the node's blockstore as a
+	// side effect of fc.RetrieveContentWithProgressCallback; when a CAR
+	// output was requested, export the retrieved DAG into it now.
+	if request.OutputPath != "" {
+		if err := t.exportToCAR(ctx, request); err != nil {
+			return nil, xerrors.Errorf("failed to export retrieved content to CAR: %w", err)
+		}
+	}
+
+	return &FILRetrievalStats{RetrievalStats: *stats}, nil
+}
+
+func (t *filTransportProtocol) exportToCAR(ctx context.Context, request RetrievalRequest) error {
+	sel, err := resolveSelector(request.Selector, request.DagScope)
+	if err != nil {
+		return err
+	}
+
+	out, err := openCAROutput(request.OutputPath, request.Root)
+	if err != nil {
+		return err
+	}
+	defer out.Finalize()
+
+	localGet := func(ctx context.Context, c cid.Cid) (blocks.Block, error) {
+		return t.node.Blockstore.Get(ctx, c)
+	}
+
+	_, err = walkSelector(ctx, request.Root, sel, localGet, out, func(uint64) {})
+	return err
+}
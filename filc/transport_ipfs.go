@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/filecoin-project/go-address"
+	"github.com/ipfs/go-blockservice"
+	blockstore "github.com/ipfs/go-ipfs-blockstore"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/multiformats/go-multiaddr"
+	"github.com/multiformats/go-multicodec"
+	"golang.org/x/xerrors"
+)
+
+// ipfsTransportProtocol retrieves content over bitswap, discovering peers for
+// the requested CID via the DHT.
+type ipfsTransportProtocol struct {
+	node *Node
+}
+
+func newIPFSTransportProtocol(node *Node) *ipfsTransportProtocol {
+	return &ipfsTransportProtocol{node: node}
+}
+
+func (t *ipfsTransportProtocol) Code() multicodec.Code {
+	return multicodec.TransportBitswap
+}
+
+func (t *ipfsTransportProtocol) Connect(ctx context.Context, candidate RetrievalCandidate, request RetrievalRequest) error {
+	// If the candidate already advertises addresses (e.g. from an
+	// IndexerCandidateSource or a prior DHT lookup merged in by
+	// mergeCandidates), dial those directly instead of repeating the
+	// discovery we already did.
+	if len(candidate.Addrs) > 0 {
+		return t.connectToAddrs(ctx, candidate)
+	}
+
+	log.Info("Searching IPFS for CID...")
+
+	providers := t.node.DHT.FindProvidersAsync(ctx, candidate.RootCid, 20)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case provider, ok := <-providers:
+			if !ok {
+				return xerrors.Errorf("no IPFS providers found for %s", candidate.RootCid)
+			}
+			if provider.ID == "" {
+				continue
+			}
+
+			log.Infof("Provider candidate %s", provider)
+
+			if err := t.node.Host.Connect(ctx, provider); err != nil {
+				log.Warnf("Failed to connect to IPFS provider %s: %v", provider, err)
+				continue
+			}
+
+			log.Infof("Connected to IPFS provider %s", provider)
+			return nil
+		}
+	}
+}
+
+// connectToAddrs dials the peer addresses a candidate already advertised,
+// trying each in turn until one succeeds. candidate.Addrs may also contain
+// non-libp2p addresses (e.g. an HTTP multiaddr merged in from the same
+// provider by mergeCandidates) - peer.AddrInfosFromP2pAddrs rejects the
+// entire list if even one address lacks a /p2p/ component, so those are
+// filtered out first.
+func (t *ipfsTransportProtocol) connectToAddrs(ctx context.Context, candidate RetrievalCandidate) error {
+	var p2pAddrs []multiaddr.Multiaddr
+	for _, addr := range candidate.Addrs {
+		if _, err := addr.ValueForProtocol(multiaddr.P_P2P); err == nil {
+			p2pAddrs = append(p2pAddrs, addr)
+		}
+	}
+	if len(p2pAddrs) == 0 {
+		return xerrors.Errorf("candidate did not advertise any usable IPFS addresses")
+	}
+
+	addrInfos, err := peer.AddrInfosFromP2pAddrs(p2pAddrs...)
+	if err != nil {
+		return xerrors.Errorf("candidate has unparseable IPFS addresses: %w", err)
+	}
+
+	var lastErr error
+	for _, addrInfo := range addrInfos {
+		if err := t.node.Host.Connect(ctx, addrInfo); err != nil {
+			log.Warnf("Failed to connect to IPFS provider %s: %v", addrInfo.ID, err)
+			lastErr = err
+			continue
+		}
+
+		log.Infof("Connected to IPFS provider %s", addrInfo.ID)
+		return nil
+	}
+
+	if lastErr == nil {
+		lastErr = xerrors.Errorf("candidate did not advertise any usable IPFS addresses")
+	}
+	return lastErr
+}
+
+// Retrieve drives the bitswap fetch with traversal.Progress over the
+// request's selector (or the default selector for its DagScope), so that
+// partial retrievals behave the same way here as they do over Graphsync.
+func (t *ipfsTransportProtocol) Retrieve(ctx context.Context, request RetrievalRequest) (RetrievalStats, error) {
+	startTime := time.Now()
+
+	log.Info("Starting IPFS retrieval")
+
+	sel, err := resolveSelector(request.Selector, request.DagScope)
+	if err != nil {
+		return nil, err
+	}
+
+	bserv := blockservice.New(t.node.Blockstore, t.node.Bitswap)
+
+	var target blockstore.Blockstore
+	if request.OutputPath != "" {
+		out, err := openCAROutput(request.OutputPath, request.Root)
+		if err != nil {
+			return nil, err
+		}
+		defer out.Finalize()
+		target = out
+	}
+
+	cb := func(bytesReceived uint64) {
+		if request.Progress != nil {
+			request.Progress(bytesReceived)
+		}
+		emitEvent(request, RetrievalEventBlockReceived, address.Undef, t.Code(), bytesReceived, nil)
+	}
+
+	bytesRetrieved, err := walkSelector(ctx, request.Root, sel, bserv.GetBlock, target, cb)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info("IPFS retrieval succeeded")
+
+	return &IPFSRetrievalStats{
+		ByteSize: bytesRetrieved,
+		Duration: time.Since(startTime),
+	}, nil
+}